@@ -0,0 +1,36 @@
+/*
+Copyright 2013 CoreOS Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import "errors"
+
+// Errors returned by CompareAndSwap, distinguished so callers (such as the
+// HTTP layer) can translate them into the right response.
+var (
+	// ErrKeyNotFound is returned when the key does not exist.
+	ErrKeyNotFound = errors.New("store: key not found")
+	// ErrTestFailed is returned when prevValue was given and did not match
+	// the key's current value.
+	ErrTestFailed = errors.New("store: compare-and-swap test failed")
+	// ErrIndexMismatch is returned when prevIndex was given and did not
+	// match the key's current ModifiedIndex.
+	ErrIndexMismatch = errors.New("store: compare-and-swap index mismatch")
+	// ErrDirectoryConflict is returned when an operation that requires a
+	// leaf key (or an empty directory) finds a non-empty directory, or vice
+	// versa, in its way.
+	ErrDirectoryConflict = errors.New("store: directory conflict")
+)
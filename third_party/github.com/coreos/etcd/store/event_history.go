@@ -0,0 +1,79 @@
+/*
+Copyright 2013 CoreOS Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"errors"
+	"sync"
+)
+
+// ErrEventIndexCleared is returned by Watch when sinceIndex is older than
+// anything left in the event history, meaning the caller must re-sync from
+// a fresh snapshot instead of replaying.
+var ErrEventIndexCleared = errors.New("store: requested event index has been cleared from history")
+
+// eventHistory is a bounded ring buffer of the most recent mutation events,
+// used to replay missed events to a newly attached Watch.
+type eventHistory struct {
+	mu         sync.RWMutex
+	Events     []*Response
+	StartIndex uint64
+	Capacity   int
+}
+
+func newEventHistory(capacity int) *eventHistory {
+	if capacity <= 0 {
+		capacity = 1
+	}
+	return &eventHistory{Capacity: capacity}
+}
+
+// add records e, evicting the oldest event once Capacity is exceeded.
+func (eh *eventHistory) add(e Response) {
+	eh.mu.Lock()
+	defer eh.mu.Unlock()
+
+	if len(eh.Events) == 0 {
+		eh.StartIndex = e.Index
+	}
+
+	eh.Events = append(eh.Events, &e)
+	if len(eh.Events) > eh.Capacity {
+		eh.Events = eh.Events[1:]
+		eh.StartIndex = eh.Events[0].Index
+	}
+}
+
+// scan returns the buffered events at or after sinceIndex whose key falls
+// under prefix, in index order. It returns ErrEventIndexCleared if
+// sinceIndex predates everything still in the buffer.
+func (eh *eventHistory) scan(prefix string, sinceIndex uint64) ([]*Response, error) {
+	eh.mu.RLock()
+	defer eh.mu.RUnlock()
+
+	if len(eh.Events) > 0 && sinceIndex < eh.StartIndex {
+		return nil, ErrEventIndexCleared
+	}
+
+	var matched []*Response
+	for _, e := range eh.Events {
+		if e.Index >= sinceIndex && underPrefix(e.Key, prefix) {
+			matched = append(matched, e)
+		}
+	}
+	return matched, nil
+}
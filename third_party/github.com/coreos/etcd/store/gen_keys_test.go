@@ -0,0 +1,33 @@
+/*
+Copyright 2013 CoreOS Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import "fmt"
+
+// GenKeys returns n distinct, depth-deep hierarchical keys for use in tests
+// and benchmarks, e.g. GenKeys(2, 3) -> []string{"/0/1/0", "/1/0/1"}.
+func GenKeys(n int, depth int) []string {
+	keys := make([]string, n)
+	for i := 0; i < n; i++ {
+		key := ""
+		for d := 0; d < depth; d++ {
+			key += fmt.Sprintf("/%d", (i+d)%n)
+		}
+		keys[i] = key
+	}
+	return keys
+}
@@ -0,0 +1,197 @@
+/*
+Copyright 2013 CoreOS Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package http exposes a store.Store as etcd's v2 `/keys` REST API.
+package http
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/etcd/store"
+)
+
+// keysPrefix is stripped from the request path to recover the store key.
+const keysPrefix = "/keys"
+
+// Handler serves the keys API out of a single store.Store. There is no
+// raft layer wired up in this tree, so Handler mints its own monotonically
+// increasing index for each mutation instead of receiving one from a log.
+// Minting the index and applying it to the store happen under the same
+// mutex so concurrent requests can't acquire them in opposite orders;
+// otherwise indices (and the auto-incremented key suffixes post() hands
+// out) could go out of order or collide.
+type Handler struct {
+	Store *store.Store
+
+	mu        sync.Mutex
+	nextIndex uint64
+}
+
+// NewHandler wraps s as an http.Handler.
+func NewHandler(s *store.Store) *Handler {
+	return &Handler{Store: s}
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, keysPrefix)
+	if key == "" {
+		key = "/"
+	}
+
+	switch r.Method {
+	case "GET":
+		h.get(w, r, key)
+	case "PUT":
+		h.put(w, r, key)
+	case "POST":
+		h.post(w, r, key)
+	case "DELETE":
+		h.delete(w, r, key)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *Handler) get(w http.ResponseWriter, r *http.Request, key string) {
+	if r.URL.Query().Get("wait") == "true" {
+		h.watch(w, r, key)
+		return
+	}
+
+	res, err := h.Store.Get(key)
+	writeResult(w, res, err)
+}
+
+func (h *Handler) watch(w http.ResponseWriter, r *http.Request, key string) {
+	waitIndex, _ := strconv.ParseUint(r.URL.Query().Get("waitIndex"), 10, 64)
+
+	ch, cancel, err := h.Store.Watch(key, waitIndex)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	defer cancel()
+
+	select {
+	case e := <-ch:
+		writeJSON(w, http.StatusOK, e)
+	case <-r.Context().Done():
+	}
+}
+
+func (h *Handler) put(w http.ResponseWriter, r *http.Request, key string) {
+	value := r.FormValue("value")
+	expireTime := expireTimeFromTTL(r.FormValue("ttl"))
+
+	prevValue := r.FormValue("prevValue")
+	prevIndex, hasPrevIndex := parseUint(r.FormValue("prevIndex"))
+
+	res, err := h.mutate(func(index uint64) ([]byte, error) {
+		if prevValue != "" || hasPrevIndex {
+			return h.Store.CompareAndSwap(key, prevValue, prevIndex, value, expireTime, index)
+		}
+		return h.Store.Set(key, value, expireTime, index)
+	})
+	writeResult(w, res, err)
+}
+
+func (h *Handler) post(w http.ResponseWriter, r *http.Request, key string) {
+	value := r.FormValue("value")
+	expireTime := expireTimeFromTTL(r.FormValue("ttl"))
+
+	res, err := h.mutate(func(index uint64) ([]byte, error) {
+		return h.Store.Create(key, value, true, expireTime, index)
+	})
+	writeResult(w, res, err)
+}
+
+func (h *Handler) delete(w http.ResponseWriter, r *http.Request, key string) {
+	recursive := r.URL.Query().Get("recursive") == "true"
+
+	res, err := h.mutate(func(index uint64) ([]byte, error) {
+		return h.Store.Delete(key, recursive, index)
+	})
+	writeResult(w, res, err)
+}
+
+// mutate mints the next mutation index and applies fn under the same lock,
+// so two concurrent requests can never mint indices in one order and apply
+// them to the store in the other.
+func (h *Handler) mutate(fn func(index uint64) ([]byte, error)) ([]byte, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.nextIndex++
+	return fn(h.nextIndex)
+}
+
+func expireTimeFromTTL(ttl string) time.Time {
+	seconds, err := strconv.ParseInt(ttl, 10, 64)
+	if err != nil || seconds <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(time.Duration(seconds) * time.Second)
+}
+
+func parseUint(s string) (uint64, bool) {
+	if s == "" {
+		return 0, false
+	}
+	v, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return v, true
+}
+
+func writeResult(w http.ResponseWriter, res []byte, err error) {
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(res)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	http.Error(w, err.Error(), errorStatus(err))
+}
+
+// errorStatus translates the store's typed errors into the status codes
+// etcd's v2 API uses; anything store doesn't have a specific type for falls
+// back to 400.
+func errorStatus(err error) int {
+	switch err {
+	case store.ErrKeyNotFound:
+		return http.StatusNotFound
+	case store.ErrTestFailed, store.ErrIndexMismatch:
+		return http.StatusPreconditionFailed
+	case store.ErrDirectoryConflict:
+		return http.StatusForbidden
+	default:
+		return http.StatusBadRequest
+	}
+}
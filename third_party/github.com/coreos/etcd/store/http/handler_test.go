@@ -0,0 +1,203 @@
+/*
+Copyright 2013 CoreOS Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package http
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coreos/etcd/store"
+)
+
+func newTestServer() *httptest.Server {
+	return httptest.NewServer(NewHandler(store.CreateStore(100)))
+}
+
+func doForm(t *testing.T, method, url string, form url.Values) *http.Response {
+	req, err := http.NewRequest(method, url, strings.NewReader(form.Encode()))
+	if err != nil {
+		t.Fatalf("Cannot build request: %s", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: %s", err)
+	}
+	return resp
+}
+
+func decode(t *testing.T, resp *http.Response) store.Response {
+	defer resp.Body.Close()
+	var r store.Response
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		t.Fatalf("Cannot decode response: %s", err)
+	}
+	return r
+}
+
+func TestHandlerGetMissing(t *testing.T) {
+	s := newTestServer()
+	defer s.Close()
+
+	resp, err := http.Get(s.URL + "/keys/foo")
+	if err != nil {
+		t.Fatalf("GET failed: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("Expected 404, got %d", resp.StatusCode)
+	}
+}
+
+func TestHandlerPutGetDelete(t *testing.T) {
+	s := newTestServer()
+	defer s.Close()
+
+	resp := doForm(t, "PUT", s.URL+"/keys/foo", url.Values{"value": {"bar"}})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("PUT failed with status %d", resp.StatusCode)
+	}
+	resp.Body.Close()
+
+	getResp, err := http.Get(s.URL + "/keys/foo")
+	if err != nil {
+		t.Fatalf("GET failed: %s", err)
+	}
+	if r := decode(t, getResp); r.Value != "bar" {
+		t.Fatalf("Expected value bar, got %q", r.Value)
+	}
+
+	req, _ := http.NewRequest("DELETE", s.URL+"/keys/foo", nil)
+	delResp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("DELETE failed: %s", err)
+	}
+	delResp.Body.Close()
+	if delResp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200 on delete, got %d", delResp.StatusCode)
+	}
+
+	finalResp, _ := http.Get(s.URL + "/keys/foo")
+	if finalResp.StatusCode != http.StatusNotFound {
+		t.Fatalf("Expected 404 after delete, got %d", finalResp.StatusCode)
+	}
+}
+
+func TestHandlerCompareAndSwapFailure(t *testing.T) {
+	s := newTestServer()
+	defer s.Close()
+
+	doForm(t, "PUT", s.URL+"/keys/foo", url.Values{"value": {"bar"}}).Body.Close()
+
+	resp := doForm(t, "PUT", s.URL+"/keys/foo", url.Values{"value": {"baz"}, "prevValue": {"nope"}})
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusPreconditionFailed {
+		t.Fatalf("Expected 412, got %d", resp.StatusCode)
+	}
+}
+
+func TestHandlerCreateAutoIncrement(t *testing.T) {
+	s := newTestServer()
+	defer s.Close()
+
+	first := doForm(t, "POST", s.URL+"/keys/queue", url.Values{"value": {"1"}})
+	r1 := decode(t, first)
+
+	second := doForm(t, "POST", s.URL+"/keys/queue", url.Values{"value": {"2"}})
+	r2 := decode(t, second)
+
+	if r1.Key == r2.Key {
+		t.Fatalf("Expected distinct auto-incremented keys, got %s twice", r1.Key)
+	}
+
+	listResp, err := http.Get(s.URL + "/keys/queue")
+	if err != nil {
+		t.Fatalf("GET failed: %s", err)
+	}
+	if r := decode(t, listResp); len(r.Nodes) != 2 {
+		t.Fatalf("Expected 2 queued nodes, got %d", len(r.Nodes))
+	}
+}
+
+func TestHandlerDeleteNonEmptyDirectory(t *testing.T) {
+	s := newTestServer()
+	defer s.Close()
+
+	doForm(t, "PUT", s.URL+"/keys/dir/foo", url.Values{"value": {"1"}}).Body.Close()
+
+	req, _ := http.NewRequest("DELETE", s.URL+"/keys/dir", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("DELETE failed: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("Expected 403 for non-recursive delete of a directory, got %d", resp.StatusCode)
+	}
+
+	recursiveReq, _ := http.NewRequest("DELETE", s.URL+"/keys/dir?recursive=true", nil)
+	recursiveResp, err := http.DefaultClient.Do(recursiveReq)
+	if err != nil {
+		t.Fatalf("Recursive DELETE failed: %s", err)
+	}
+	recursiveResp.Body.Close()
+	if recursiveResp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200 for recursive delete, got %d", recursiveResp.StatusCode)
+	}
+}
+
+func TestHandlerWatch(t *testing.T) {
+	s := newTestServer()
+	defer s.Close()
+
+	done := make(chan store.Response, 1)
+	go func() {
+		resp, err := http.Get(s.URL + "/keys/foo?wait=true")
+		if err != nil {
+			t.Errorf("Watch GET failed: %s", err)
+			return
+		}
+		defer resp.Body.Close()
+
+		var r store.Response
+		if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+			t.Errorf("Cannot decode watch response: %s", err)
+			return
+		}
+		done <- r
+	}()
+
+	// give the watch a moment to attach before firing the mutation.
+	time.Sleep(100 * time.Millisecond)
+	doForm(t, "PUT", s.URL+"/keys/foo", url.Values{"value": {"bar"}}).Body.Close()
+
+	select {
+	case r := <-done:
+		if r.Value != "bar" {
+			t.Fatalf("Expected watched value bar, got %q", r.Value)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Timed out waiting for watch response")
+	}
+}
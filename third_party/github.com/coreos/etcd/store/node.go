@@ -0,0 +1,172 @@
+/*
+Copyright 2013 CoreOS Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"sort"
+	"time"
+)
+
+// isPermanent reports whether t means "never expires." Besides the zero
+// time.Time, the Unix epoch itself is treated the same way, since that's
+// what callers get from time.Unix(0, 0) when they don't otherwise track
+// an expiration.
+func isPermanent(t time.Time) bool {
+	return t.IsZero() || t.Equal(time.Unix(0, 0))
+}
+
+// node is a single entry in the key tree. It is either a leaf holding a
+// value or a directory holding children, never both.
+type node struct {
+	Path string
+
+	Value    string
+	Dir      bool
+	Children map[string]*node
+	Parent   *node
+
+	CreateIndex   uint64
+	ModifiedIndex uint64
+
+	ExpireTime time.Time
+	ttlTimer   *time.Timer
+}
+
+func newDirNode(p string, index uint64) *node {
+	return &node{
+		Path:          p,
+		Dir:           true,
+		Children:      make(map[string]*node),
+		CreateIndex:   index,
+		ModifiedIndex: index,
+	}
+}
+
+func newKVNode(p string, value string, index uint64) *node {
+	return &node{
+		Path:          p,
+		Value:         value,
+		CreateIndex:   index,
+		ModifiedIndex: index,
+	}
+}
+
+// ExpireSet arranges for n to be removed from the tree when expireTime is
+// reached. A zero expireTime means the node never expires. A directory's
+// timer only ever fires for the directory itself; expireLocked is what
+// cascades that removal through any children with their own, independently
+// scheduled TTLs.
+//
+// The caller must already hold s.mu.
+func (n *node) ExpireSet(s *Store, expireTime time.Time) {
+	if n.ttlTimer != nil {
+		n.ttlTimer.Stop()
+		n.ttlTimer = nil
+	}
+
+	n.ExpireTime = expireTime
+
+	if isPermanent(expireTime) {
+		return
+	}
+
+	duration := expireTime.Sub(time.Now())
+	if duration <= 0 {
+		// ExpireSet only ever runs synchronously from inside a mutation
+		// method that's still assembling its own response and notification
+		// (Set, Create, ...); unlike a timer actually firing later on, there
+		// is no separate "expire" event to raise here. Just drop the node;
+		// the caller's own notify is the only event this call should emit.
+		n.remove()
+		return
+	}
+
+	n.ttlTimer = time.AfterFunc(duration, func() {
+		n.expire(s)
+	})
+}
+
+// expire is the timer callback: it acquires s.mu itself before removing n.
+func (n *node) expire(s *Store) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n.expireLocked(s)
+}
+
+// expireLocked removes n (and, for a directory, every descendant, each of
+// which may have its own independently scheduled TTL) from the tree and
+// notifies watchers. The caller must already hold s.mu.
+func (n *node) expireLocked(s *Store) {
+	// the node may have already been removed or refreshed with a new
+	// expiration between the timer firing and the lock being acquired.
+	if n.Parent == nil || n.Parent.Children[lastSegment(n.Path)] != n {
+		return
+	}
+
+	n.cascadeExpire(s)
+}
+
+// cascadeExpire detaches n and, recursively, every descendant from the
+// tree, deepest first, notifying watchers once per node actually removed.
+// Descending first (rather than just dropping the whole subtree via a
+// single n.remove()) is what lets each descendant's own expiry be
+// reported; each descendant's TTL timer is stopped by its own remove().
+func (n *node) cascadeExpire(s *Store) {
+	for _, name := range n.sortedChildNames() {
+		n.Children[name].cascadeExpire(s)
+	}
+
+	n.remove()
+
+	s.Index++
+	s.notify(Response{
+		Action:        actionExpire,
+		Key:           n.Path,
+		Dir:           n.Dir,
+		Index:         s.Index,
+		CreateIndex:   n.CreateIndex,
+		ModifiedIndex: n.ModifiedIndex,
+	})
+}
+
+// remove detaches n, and recursively every descendant, from the tree,
+// stopping each one's TTL timer so an orphaned timer can't later fire for
+// a node that's already gone.
+func (n *node) remove() {
+	for _, child := range n.Children {
+		child.remove()
+	}
+	if n.ttlTimer != nil {
+		n.ttlTimer.Stop()
+		n.ttlTimer = nil
+	}
+	if n.Parent != nil {
+		delete(n.Parent.Children, lastSegment(n.Path))
+		n.Parent = nil
+	}
+}
+
+// sortedChildNames returns the node's child names in lexical order so that
+// listings are stable.
+func (n *node) sortedChildNames() []string {
+	names := make([]string, 0, len(n.Children))
+	for name := range n.Children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,64 @@
+/*
+Copyright 2013 CoreOS Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"strings"
+)
+
+// normalize turns a user-supplied key into a canonical absolute path: a
+// leading slash, no trailing slash (except for the root itself) and no
+// empty segments.
+func normalize(key string) string {
+	segments := splitPath(key)
+	if len(segments) == 0 {
+		return "/"
+	}
+	return "/" + strings.Join(segments, "/")
+}
+
+// splitPath breaks a key into its non-empty segments, e.g.
+// "/foo/bar/" -> []string{"foo", "bar"}.
+func splitPath(key string) []string {
+	parts := strings.Split(key, "/")
+	segments := make([]string, 0, len(parts))
+	for _, p := range parts {
+		if p != "" {
+			segments = append(segments, p)
+		}
+	}
+	return segments
+}
+
+// lastSegment returns the final path segment of key, the name a node is
+// stored under in its parent's Children map.
+func lastSegment(key string) string {
+	segments := splitPath(key)
+	if len(segments) == 0 {
+		return "/"
+	}
+	return segments[len(segments)-1]
+}
+
+// underPrefix reports whether key is prefix itself or lives somewhere
+// beneath it. Both are assumed already normalized.
+func underPrefix(key, prefix string) bool {
+	if prefix == "/" {
+		return true
+	}
+	return key == prefix || strings.HasPrefix(key, prefix+"/")
+}
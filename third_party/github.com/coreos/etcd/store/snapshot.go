@@ -0,0 +1,131 @@
+/*
+Copyright 2013 CoreOS Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// snapNode is the on-disk representation of a single node, used to walk the
+// tree without serializing the Parent back-pointers.
+type snapNode struct {
+	Path          string               `json:"path"`
+	Value         string               `json:"value,omitempty"`
+	Dir           bool                 `json:"dir,omitempty"`
+	CreateIndex   uint64               `json:"createIndex"`
+	ModifiedIndex uint64               `json:"modifiedIndex"`
+	ExpireTime    time.Time            `json:"expireTime,omitempty"`
+	Children      map[string]*snapNode `json:"children,omitempty"`
+}
+
+func nodeToSnap(n *node) *snapNode {
+	sn := &snapNode{
+		Path:          n.Path,
+		Value:         n.Value,
+		Dir:           n.Dir,
+		CreateIndex:   n.CreateIndex,
+		ModifiedIndex: n.ModifiedIndex,
+		ExpireTime:    n.ExpireTime,
+	}
+	if n.Dir {
+		sn.Children = make(map[string]*snapNode, len(n.Children))
+		for name, child := range n.Children {
+			sn.Children[name] = nodeToSnap(child)
+		}
+	}
+	return sn
+}
+
+// snapToNode rebuilds a node from its snapshot, skipping anything whose TTL
+// has already passed rather than reviving it as live and then immediately
+// expiring it.
+func snapToNode(s *Store, sn *snapNode, parent *node) *node {
+	if !isPermanent(sn.ExpireTime) && !sn.ExpireTime.After(time.Now()) {
+		return nil
+	}
+
+	var n *node
+	if sn.Dir {
+		n = newDirNode(sn.Path, sn.CreateIndex)
+	} else {
+		n = newKVNode(sn.Path, sn.Value, sn.CreateIndex)
+	}
+	n.ModifiedIndex = sn.ModifiedIndex
+	n.Parent = parent
+
+	if sn.Dir {
+		for name, childSnap := range sn.Children {
+			if child := snapToNode(s, childSnap, n); child != nil {
+				n.Children[name] = child
+			}
+		}
+	}
+
+	if !isPermanent(sn.ExpireTime) {
+		n.ExpireSet(s, sn.ExpireTime)
+	}
+
+	return n
+}
+
+// SaveJSON serializes the entire tree to a single JSON blob, suitable for
+// RecoverJSON. It predates the snappy-streamed format used by Save and is
+// kept around for snapshots written by older versions of the store.
+func (s *Store) SaveJSON() ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return json.Marshal(nodeToSnap(s.Root))
+}
+
+// RecoverJSON replaces the store's tree with the one encoded in state, as
+// produced by SaveJSON. Nodes already past their expiration are dropped
+// rather than restored.
+func (s *Store) RecoverJSON(state []byte) error {
+	var root snapNode
+	if err := json.Unmarshal(state, &root); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.Root = snapToNode(s, &root, nil)
+	return nil
+}
+
+// clone returns a deep copy of the store, used by callers (such as
+// benchmarks) that want to snapshot the tree without holding s.mu.
+func (s *Store) clone() *Store {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	clone := &Store{
+		Index:   s.Index,
+		Max:     s.Max,
+		history: newEventHistory(s.Max),
+		hub:     newWatcherHub(),
+		codec:   s.codec,
+	}
+	clone.Root = snapToNode(clone, nodeToSnap(s.Root), nil)
+	return clone
+}
+
+func responseToJSON(r Response) ([]byte, error) {
+	return json.Marshal(r)
+}
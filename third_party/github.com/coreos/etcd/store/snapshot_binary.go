@@ -0,0 +1,254 @@
+/*
+Copyright 2013 CoreOS Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/golang/snappy"
+)
+
+// snapshotMagic identifies the snappy-streamed snapshot format so Recovery
+// can tell it apart from a legacy JSON blob without decompressing anything.
+const snapshotMagic = "ESN1"
+
+// snapshotHeader is written in the clear, right after snapshotMagic, so a
+// reader can learn Index and EntryCount before touching the compressed body.
+type snapshotHeader struct {
+	Index      uint64
+	EntryCount uint64
+}
+
+// Save serializes the tree in the binary, snappy-compressed format written
+// by SaveTo. Use SaveJSON if you need the older, uncompressed format.
+func (s *Store) Save() ([]byte, error) {
+	var buf bytes.Buffer
+	if err := s.SaveTo(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// SaveTo writes every node to w as a small plaintext header (magic, version
+// implied by magic, index, entry count) followed by the nodes themselves,
+// length-prefixed and run through a snappy stream writer.
+func (s *Store) SaveTo(w io.Writer) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var entries []*node
+	flattenPreOrder(s.Root, &entries)
+
+	if _, err := io.WriteString(w, snapshotMagic); err != nil {
+		return err
+	}
+	header := snapshotHeader{Index: s.Index, EntryCount: uint64(len(entries))}
+	if err := binary.Write(w, binary.BigEndian, header); err != nil {
+		return err
+	}
+
+	sw := snappy.NewWriter(w)
+	bw := bufio.NewWriter(sw)
+	for _, n := range entries {
+		if err := writeEntry(bw, n); err != nil {
+			return err
+		}
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	return sw.Close()
+}
+
+// Recovery replaces the store's tree with the one encoded in state. It
+// sniffs the leading magic bytes to tell the binary format written by Save
+// apart from a legacy JSON blob written by SaveJSON, so either can be
+// passed in.
+func (s *Store) Recovery(state []byte) error {
+	if len(state) >= len(snapshotMagic) && string(state[:len(snapshotMagic)]) == snapshotMagic {
+		return s.RecoverFrom(bytes.NewReader(state))
+	}
+	return s.RecoverJSON(state)
+}
+
+// RecoverFrom rebuilds the tree from the binary format written by SaveTo.
+func (s *Store) RecoverFrom(r io.Reader) error {
+	magic := make([]byte, len(snapshotMagic))
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return err
+	}
+	if string(magic) != snapshotMagic {
+		return fmt.Errorf("store: unrecognized snapshot magic %q", magic)
+	}
+
+	var header snapshotHeader
+	if err := binary.Read(r, binary.BigEndian, &header); err != nil {
+		return err
+	}
+
+	br := bufio.NewReader(snappy.NewReader(r))
+
+	nodes := make(map[string]*node, header.EntryCount)
+	var root *node
+	for i := uint64(0); i < header.EntryCount; i++ {
+		n, err := readEntry(br)
+		if err != nil {
+			return err
+		}
+		nodes[n.Path] = n
+
+		if n.Path == "/" {
+			root = n
+			continue
+		}
+		parent, ok := nodes[parentOf(n.Path)]
+		if !ok {
+			return fmt.Errorf("store: snapshot entry %s has no parent", n.Path)
+		}
+		n.Parent = parent
+		parent.Children[lastSegment(n.Path)] = n
+	}
+	if root == nil {
+		return fmt.Errorf("store: snapshot is missing its root node")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.Root = root
+	s.Index = header.Index
+
+	// Entries were read as plain nodes; now that the tree is wired back
+	// together, arm TTLs (or drop anything that already expired) for real.
+	for _, n := range nodes {
+		if isPermanent(n.ExpireTime) {
+			continue
+		}
+		if !n.ExpireTime.After(time.Now()) {
+			n.remove()
+			continue
+		}
+		n.ExpireSet(s, n.ExpireTime)
+	}
+
+	return nil
+}
+
+// flattenPreOrder walks n depth-first, parent before children, so
+// RecoverFrom can always find an entry's parent already reconstructed.
+func flattenPreOrder(n *node, out *[]*node) {
+	*out = append(*out, n)
+	if !n.Dir {
+		return
+	}
+	for _, name := range n.sortedChildNames() {
+		flattenPreOrder(n.Children[name], out)
+	}
+}
+
+func writeEntry(w *bufio.Writer, n *node) error {
+	if err := writeString(w, n.Path); err != nil {
+		return err
+	}
+	if err := writeString(w, n.Value); err != nil {
+		return err
+	}
+
+	dirByte := byte(0)
+	if n.Dir {
+		dirByte = 1
+	}
+	if err := w.WriteByte(dirByte); err != nil {
+		return err
+	}
+
+	var expireNano int64
+	if !isPermanent(n.ExpireTime) {
+		expireNano = n.ExpireTime.UnixNano()
+	}
+	if err := binary.Write(w, binary.BigEndian, expireNano); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.BigEndian, n.CreateIndex); err != nil {
+		return err
+	}
+	return binary.Write(w, binary.BigEndian, n.ModifiedIndex)
+}
+
+func readEntry(r *bufio.Reader) (*node, error) {
+	path, err := readString(r)
+	if err != nil {
+		return nil, err
+	}
+	value, err := readString(r)
+	if err != nil {
+		return nil, err
+	}
+	dirByte, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	var expireNano int64
+	if err := binary.Read(r, binary.BigEndian, &expireNano); err != nil {
+		return nil, err
+	}
+	var createIndex, modifiedIndex uint64
+	if err := binary.Read(r, binary.BigEndian, &createIndex); err != nil {
+		return nil, err
+	}
+	if err := binary.Read(r, binary.BigEndian, &modifiedIndex); err != nil {
+		return nil, err
+	}
+
+	var n *node
+	if dirByte == 1 {
+		n = newDirNode(path, createIndex)
+	} else {
+		n = newKVNode(path, value, createIndex)
+	}
+	n.ModifiedIndex = modifiedIndex
+	if expireNano != 0 {
+		n.ExpireTime = time.Unix(0, expireNano)
+	}
+	return n, nil
+}
+
+func writeString(w *bufio.Writer, s string) error {
+	if err := binary.Write(w, binary.BigEndian, uint32(len(s))); err != nil {
+		return err
+	}
+	_, err := w.WriteString(s)
+	return err
+}
+
+func readString(r *bufio.Reader) (string, error) {
+	var length uint32
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return "", err
+	}
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
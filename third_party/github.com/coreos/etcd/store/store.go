@@ -0,0 +1,466 @@
+/*
+Copyright 2013 CoreOS Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package store implements the in-memory, hierarchical key/value tree that
+// backs etcd's `/v2/keys` API.
+package store
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	actionGet        = "get"
+	actionSet        = "set"
+	actionCreate     = "create"
+	actionUpdate     = "update"
+	actionDelete     = "delete"
+	actionExpire     = "expire"
+	actionTestAndSet = "compareAndSwap"
+)
+
+// Response is the JSON representation returned to callers for every read or
+// write against the store. Dir and Nodes are only populated when Key names a
+// directory. CreateIndex and ModifiedIndex are the key's own indices, as
+// opposed to Index, which is the index of the operation that produced this
+// Response; a client doing a read-modify-write should CompareAndSwap against
+// ModifiedIndex, not Index, since Index moves on every mutation store-wide
+// while ModifiedIndex only moves when this particular key does.
+type Response struct {
+	Action        string     `json:"action"`
+	Key           string     `json:"key"`
+	Dir           bool       `json:"dir,omitempty"`
+	PrevValue     string     `json:"prevValue,omitempty"`
+	Value         string     `json:"value,omitempty"`
+	Nodes         []Response `json:"nodes,omitempty"`
+	Expiration    *time.Time `json:"expiration,omitempty"`
+	Index         uint64     `json:"index"`
+	CreateIndex   uint64     `json:"createdIndex"`
+	ModifiedIndex uint64     `json:"modifiedIndex"`
+}
+
+// Store is a thread-safe, in-memory tree of key/value nodes.
+type Store struct {
+	mu sync.Mutex
+
+	Root  *node
+	Index uint64
+
+	// Max bounds the amount of mutation history the store keeps around for
+	// watchers; it has no effect on the tree itself.
+	Max int
+
+	history *eventHistory
+	hub     *watcherHub
+	codec   Codec
+}
+
+// CreateStore returns an empty Store using the default JSON codec for
+// SetObject/GetObject. max bounds how much mutation history is retained for
+// watchers.
+func CreateStore(max int) *Store {
+	return CreateStoreWithCodec(max, jsonCodec{})
+}
+
+// CreateStoreWithCodec is like CreateStore but lets SetObject/GetObject
+// marshal values with c instead of JSON.
+func CreateStoreWithCodec(max int, c Codec) *Store {
+	return &Store{
+		Root:    newDirNode("/", 0),
+		Max:     max,
+		history: newEventHistory(max),
+		hub:     newWatcherHub(),
+		codec:   c,
+	}
+}
+
+// Watch subscribes to mutations under prefix. If sinceIndex is non-zero and
+// still covered by the event history, matching events since that index are
+// replayed on the returned channel before it goes live; if sinceIndex has
+// already fallen out of the history, ErrEventIndexCleared is returned so the
+// caller can re-sync from a fresh snapshot instead. The returned CancelFunc
+// stops the subscription and closes the channel; since Watch spawns no
+// goroutines of its own, cancelling never leaks one. CancelFunc is safe to
+// call more than once.
+func (s *Store) Watch(prefix string, sinceIndex uint64) (<-chan Response, CancelFunc, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	prefix = normalize(prefix)
+
+	var replay []*Response
+	if sinceIndex > 0 {
+		events, err := s.history.scan(prefix, sinceIndex)
+		if err != nil {
+			return nil, nil, err
+		}
+		replay = events
+	}
+
+	ch := make(chan Response, len(replay)+watchChanBuffer)
+	for _, e := range replay {
+		ch <- *e
+	}
+
+	w := &watcher{ch: ch, prefix: prefix}
+	s.hub.add(w)
+
+	var once sync.Once
+	cancel := func() {
+		once.Do(func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			s.hub.remove(w)
+			close(ch)
+		})
+	}
+	return ch, cancel, nil
+}
+
+// Get retrieves the node at key. If key names a directory the returned
+// Response's Nodes field holds its immediate children, sorted by name.
+func (s *Store) Get(key string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n, err := s.find(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return responseToJSON(s.nodeToResponse(actionGet, n))
+}
+
+// Set creates or overwrites the value at key, vivifying any missing parent
+// directories along the way.
+func (s *Store) Set(key string, value string, expireTime time.Time, index uint64) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key = normalize(key)
+
+	prev := ""
+	n, err := s.find(key)
+	if err == nil {
+		if n.Dir {
+			return nil, ErrDirectoryConflict
+		}
+		prev = n.Value
+		n.Value = value
+		n.ModifiedIndex = index
+	} else {
+		parent, err := s.ensureDir(parentOf(key), index)
+		if err != nil {
+			return nil, err
+		}
+		n = newKVNode(key, value, index)
+		n.Parent = parent
+		parent.Children[lastSegment(key)] = n
+	}
+
+	n.ExpireSet(s, expireTime)
+	s.Index = index
+
+	resp := s.nodeToResponse(actionSet, n)
+	resp.PrevValue = prev
+	s.notify(resp)
+	return responseToJSON(resp)
+}
+
+// Create adds a new key. It fails if the key already exists. When
+// incrementalSuffix is true, key is treated as a directory and the new node
+// is created under it with an auto-incrementing numeric name (etcd's
+// in-order key convention).
+func (s *Store) Create(key string, value string, incrementalSuffix bool, expireTime time.Time, index uint64) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key = normalize(key)
+
+	if incrementalSuffix {
+		parent, err := s.ensureDir(key, index)
+		if err != nil {
+			return nil, err
+		}
+		if key == "/" {
+			key = fmt.Sprintf("/%020d", index)
+		} else {
+			key = fmt.Sprintf("%s/%020d", key, index)
+		}
+		n := newKVNode(key, value, index)
+		n.Parent = parent
+		parent.Children[lastSegment(key)] = n
+		n.ExpireSet(s, expireTime)
+		s.Index = index
+
+		resp := s.nodeToResponse(actionCreate, n)
+		s.notify(resp)
+		return responseToJSON(resp)
+	}
+
+	if _, err := s.find(key); err == nil {
+		return nil, fmt.Errorf("store: key %s already exists", key)
+	}
+
+	parent, err := s.ensureDir(parentOf(key), index)
+	if err != nil {
+		return nil, err
+	}
+
+	n := newKVNode(key, value, index)
+	n.Parent = parent
+	parent.Children[lastSegment(key)] = n
+	n.ExpireSet(s, expireTime)
+	s.Index = index
+
+	resp := s.nodeToResponse(actionCreate, n)
+	s.notify(resp)
+	return responseToJSON(resp)
+}
+
+// Update changes the value at key. It fails if key does not already exist.
+func (s *Store) Update(key string, value string, expireTime time.Time, index uint64) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key = normalize(key)
+
+	n, err := s.find(key)
+	if err != nil {
+		return nil, ErrKeyNotFound
+	}
+	if n.Dir {
+		return nil, ErrDirectoryConflict
+	}
+
+	prev := n.Value
+	n.Value = value
+	n.ModifiedIndex = index
+	n.ExpireSet(s, expireTime)
+	s.Index = index
+
+	resp := s.nodeToResponse(actionUpdate, n)
+	resp.PrevValue = prev
+	s.notify(resp)
+	return responseToJSON(resp)
+}
+
+// Delete removes key. Deleting a non-empty directory requires recursive to
+// be true.
+func (s *Store) Delete(key string, recursive bool, index uint64) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key = normalize(key)
+
+	if key == "/" {
+		return nil, fmt.Errorf("store: cannot delete root")
+	}
+
+	n, err := s.find(key)
+	if err != nil {
+		return nil, ErrKeyNotFound
+	}
+	if n.Dir && len(n.Children) > 0 && !recursive {
+		return nil, ErrDirectoryConflict
+	}
+
+	s.Index = index
+	resp := s.nodeToResponse(actionDelete, n)
+	n.remove()
+
+	s.notify(resp)
+	return responseToJSON(resp)
+}
+
+// TestAndSet performs a compare-and-swap on key's value, succeeding only if
+// the current value equals prevValue. If key does not exist, an empty
+// prevValue creates it with value; any other prevValue fails with
+// ErrKeyNotFound.
+func (s *Store) TestAndSet(key string, prevValue string, value string, expireTime time.Time, index uint64) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key = normalize(key)
+
+	n, err := s.find(key)
+	if err != nil {
+		if prevValue != "" {
+			return nil, ErrKeyNotFound
+		}
+		parent, err := s.ensureDir(parentOf(key), index)
+		if err != nil {
+			return nil, err
+		}
+		n = newKVNode(key, value, index)
+		n.Parent = parent
+		parent.Children[lastSegment(key)] = n
+		n.ExpireSet(s, expireTime)
+		s.Index = index
+
+		resp := s.nodeToResponse(actionTestAndSet, n)
+		s.notify(resp)
+		return responseToJSON(resp)
+	}
+
+	if n.Dir {
+		return nil, ErrDirectoryConflict
+	}
+	if n.Value != prevValue {
+		return nil, ErrTestFailed
+	}
+
+	prev := n.Value
+	n.Value = value
+	n.ModifiedIndex = index
+	n.ExpireSet(s, expireTime)
+	s.Index = index
+
+	resp := s.nodeToResponse(actionTestAndSet, n)
+	resp.PrevValue = prev
+	s.notify(resp)
+	return responseToJSON(resp)
+}
+
+// CompareAndSwap changes key's value, succeeding only if the checks that
+// are not wildcarded all pass: prevValue == "" skips the value check and
+// prevIndex == 0 skips the ModifiedIndex check, so a caller may check
+// either, both, or neither. Unlike TestAndSet, an empty prevValue is never
+// treated as a request to create the key; CompareAndSwap always requires
+// key to already exist.
+func (s *Store) CompareAndSwap(key string, prevValue string, prevIndex uint64, value string, expireTime time.Time, index uint64) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key = normalize(key)
+
+	n, err := s.find(key)
+	if err != nil {
+		return nil, ErrKeyNotFound
+	}
+	if n.Dir {
+		return nil, ErrDirectoryConflict
+	}
+	if prevValue != "" && n.Value != prevValue {
+		return nil, ErrTestFailed
+	}
+	if prevIndex != 0 && n.ModifiedIndex != prevIndex {
+		return nil, ErrIndexMismatch
+	}
+
+	prev := n.Value
+	n.Value = value
+	n.ModifiedIndex = index
+	n.ExpireSet(s, expireTime)
+	s.Index = index
+
+	resp := s.nodeToResponse(actionTestAndSet, n)
+	resp.PrevValue = prev
+	s.notify(resp)
+	return responseToJSON(resp)
+}
+
+// notify records r in the event history and fans it out to any matching
+// watchers. The caller must already hold s.mu.
+func (s *Store) notify(r Response) {
+	s.history.add(r)
+	s.hub.notify(r)
+}
+
+// find looks up the node at key, assumed already normalized, without
+// acquiring s.mu.
+func (s *Store) find(key string) (*node, error) {
+	cur := s.Root
+	for _, seg := range splitPath(key) {
+		if !cur.Dir {
+			return nil, fmt.Errorf("store: %s is not a directory", cur.Path)
+		}
+		next, ok := cur.Children[seg]
+		if !ok {
+			return nil, ErrKeyNotFound
+		}
+		cur = next
+	}
+	return cur, nil
+}
+
+// ensureDir walks dirPath, assumed already normalized, creating any missing
+// directory nodes along the way.
+func (s *Store) ensureDir(dirPath string, index uint64) (*node, error) {
+	cur := s.Root
+	built := "/"
+	for _, seg := range splitPath(dirPath) {
+		if !cur.Dir {
+			return nil, fmt.Errorf("store: %s is not a directory", cur.Path)
+		}
+		built = built + seg + "/"
+		next, ok := cur.Children[seg]
+		if !ok {
+			next = newDirNode(normalize(built), index)
+			next.Parent = cur
+			cur.Children[seg] = next
+		} else if !next.Dir {
+			return nil, ErrDirectoryConflict
+		}
+		cur = next
+	}
+	return cur, nil
+}
+
+func parentOf(key string) string {
+	segments := splitPath(key)
+	if len(segments) <= 1 {
+		return "/"
+	}
+	return "/" + joinSegments(segments[:len(segments)-1])
+}
+
+func joinSegments(segments []string) string {
+	out := ""
+	for i, s := range segments {
+		if i > 0 {
+			out += "/"
+		}
+		out += s
+	}
+	return out
+}
+
+// nodeToResponse converts n into its wire representation, recursing into
+// children when n is a directory.
+func (s *Store) nodeToResponse(action string, n *node) Response {
+	resp := Response{
+		Action:        action,
+		Key:           n.Path,
+		Dir:           n.Dir,
+		Value:         n.Value,
+		Index:         s.Index,
+		CreateIndex:   n.CreateIndex,
+		ModifiedIndex: n.ModifiedIndex,
+	}
+	if !isPermanent(n.ExpireTime) {
+		t := n.ExpireTime
+		resp.Expiration = &t
+	}
+	if n.Dir {
+		for _, name := range n.sortedChildNames() {
+			resp.Nodes = append(resp.Nodes, s.nodeToResponse(actionGet, n.Children[name]))
+		}
+	}
+	return resp
+}
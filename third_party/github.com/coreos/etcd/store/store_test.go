@@ -18,6 +18,7 @@ package store
 
 import (
 	"encoding/json"
+	"strings"
 	"testing"
 	"time"
 )
@@ -39,7 +40,7 @@ func TestStoreGetDelete(t *testing.T) {
 		t.Fatalf("Cannot get stored value")
 	}
 
-	s.Delete("foo", 2)
+	s.Delete("foo", false, 2)
 	_, err = s.Get("foo")
 
 	if err == nil {
@@ -47,6 +48,221 @@ func TestStoreGetDelete(t *testing.T) {
 	}
 }
 
+func TestStoreCreateUpdate(t *testing.T) {
+	s := CreateStore(100)
+
+	_, err := s.Create("/foo/bar", "baz", false, time.Unix(0, 0), 1)
+	if err != nil {
+		t.Fatalf("Cannot create /foo/bar: %s", err)
+	}
+
+	_, err = s.Create("/foo/bar", "baz2", false, time.Unix(0, 0), 2)
+	if err == nil {
+		t.Fatalf("Create should fail on an existing key")
+	}
+
+	_, err = s.Update("/foo/bar", "baz2", time.Unix(0, 0), 3)
+	if err != nil {
+		t.Fatalf("Cannot update /foo/bar: %s", err)
+	}
+
+	_, err = s.Update("/foo/nope", "baz", time.Unix(0, 0), 4)
+	if err == nil {
+		t.Fatalf("Update should fail on a missing key")
+	}
+}
+
+func TestStoreDirectoryListing(t *testing.T) {
+	s := CreateStore(100)
+
+	s.Set("/foo/bar", "1", time.Unix(0, 0), 1)
+	s.Set("/foo/baz", "2", time.Unix(0, 0), 2)
+
+	res, err := s.Get("/foo")
+	if err != nil {
+		t.Fatalf("Cannot get /foo: %s", err)
+	}
+
+	var result Response
+	json.Unmarshal(res, &result)
+
+	if !result.Dir {
+		t.Fatalf("/foo should be reported as a directory")
+	}
+	if len(result.Nodes) != 2 {
+		t.Fatalf("Expected 2 children, got %d", len(result.Nodes))
+	}
+	if result.Nodes[0].Key != "/foo/bar" || result.Nodes[1].Key != "/foo/baz" {
+		t.Fatalf("Children should be sorted by key, got %v", result.Nodes)
+	}
+}
+
+func TestStoreDeleteDirectory(t *testing.T) {
+	s := CreateStore(100)
+
+	s.Set("/foo/bar", "1", time.Unix(0, 0), 1)
+
+	_, err := s.Delete("/foo", false, 2)
+	if err == nil {
+		t.Fatalf("Non-recursive delete of a non-empty directory should fail")
+	}
+
+	_, err = s.Delete("/foo", true, 3)
+	if err != nil {
+		t.Fatalf("Recursive delete of a non-empty directory should succeed: %s", err)
+	}
+
+	_, err = s.Get("/foo")
+	if err == nil {
+		t.Fatalf("Got a directory deleted recursively")
+	}
+}
+
+func TestStoreDirectoryExpireCascade(t *testing.T) {
+	s := CreateStore(100)
+
+	s.Set("/foo/bar", "1", time.Unix(0, 0), 1)
+	s.Set("/foo/baz", "2", time.Unix(0, 0), 2)
+
+	// give the directory itself a TTL; its children only hang off its
+	// Children map, so expiring it must take them with it.
+	s.mu.Lock()
+	dir, err := s.find("/foo")
+	if err != nil {
+		s.mu.Unlock()
+		t.Fatalf("Cannot find /foo: %s", err)
+	}
+	dir.ExpireSet(s, time.Now().Add(time.Second*1))
+	s.mu.Unlock()
+
+	time.Sleep(2 * time.Second)
+
+	if _, err := s.Get("/foo/bar"); err == nil {
+		t.Fatalf("Got value under an expired directory")
+	}
+	if _, err := s.Get("/foo"); err == nil {
+		t.Fatalf("Got an expired directory")
+	}
+}
+
+func TestStoreDirectoryExpireCascadeStopsChildTimers(t *testing.T) {
+	s := CreateStore(100)
+
+	// /foo/bar's own TTL (3s) is longer than the directory's (1s); the
+	// directory's cascade must stop bar's independent timer rather than
+	// leaving it to fire a phantom expire event for a key that's already
+	// gone.
+	s.Set("/foo/bar", "1", time.Now().Add(time.Second*3), 1)
+
+	ch, cancel, err := s.Watch("/foo", 0)
+	if err != nil {
+		t.Fatalf("Cannot watch: %s", err)
+	}
+	defer cancel()
+
+	s.mu.Lock()
+	dir, err := s.find("/foo")
+	if err != nil {
+		s.mu.Unlock()
+		t.Fatalf("Cannot find /foo: %s", err)
+	}
+	dir.ExpireSet(s, time.Now().Add(time.Second*1))
+	s.mu.Unlock()
+
+	var seen []Response
+	for i := 0; i < 2; i++ {
+		select {
+		case e := <-ch:
+			seen = append(seen, e)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Timed out waiting for cascade expire events, got %d so far", len(seen))
+		}
+	}
+
+	for _, e := range seen {
+		if e.Action != actionExpire {
+			t.Fatalf("Expected expire events, got %s", e.Action)
+		}
+	}
+
+	// bar's own, now-orphaned timer must not still be live.
+	select {
+	case e := <-ch:
+		t.Fatalf("Got a second, phantom event for %s after the cascade", e.Key)
+	case <-time.After(3 * time.Second):
+	}
+}
+
+func TestStoreSaveRecoveryTree(t *testing.T) {
+	s := CreateStore(100)
+
+	s.Set("/foo/bar", "1", time.Unix(0, 0), 1)
+	s.Set("/foo/baz", "2", time.Unix(0, 0), 2)
+
+	state, err := s.Save()
+	if err != nil {
+		t.Fatalf("Cannot save: %s", err)
+	}
+
+	newStore := CreateStore(100)
+	if err := newStore.Recovery(state); err != nil {
+		t.Fatalf("Cannot recover: %s", err)
+	}
+
+	res, err := newStore.Get("/foo")
+	if err != nil {
+		t.Fatalf("Cannot get /foo after recovery: %s", err)
+	}
+
+	var result Response
+	json.Unmarshal(res, &result)
+
+	if len(result.Nodes) != 2 {
+		t.Fatalf("Expected 2 children after recovery, got %d", len(result.Nodes))
+	}
+}
+
+func TestSnapshotFormats(t *testing.T) {
+	s := CreateStore(100)
+
+	s.Set("/foo/bar", "1", time.Unix(0, 0), 1)
+	s.Set("/foo/baz", "2", time.Unix(0, 0), 2)
+
+	snappyState, err := s.Save()
+	if err != nil {
+		t.Fatalf("Cannot save snappy snapshot: %s", err)
+	}
+	if string(snappyState[:len(snapshotMagic)]) != snapshotMagic {
+		t.Fatalf("Save did not write the expected magic header")
+	}
+
+	jsonState, err := s.SaveJSON()
+	if err != nil {
+		t.Fatalf("Cannot save JSON snapshot: %s", err)
+	}
+
+	snappyStore := CreateStore(100)
+	if err := snappyStore.Recovery(snappyState); err != nil {
+		t.Fatalf("Cannot recover snappy snapshot: %s", err)
+	}
+	res, _ := snappyStore.Get("/foo/bar")
+	var result Response
+	json.Unmarshal(res, &result)
+	if result.Value != "1" {
+		t.Fatalf("Snappy round-trip lost data")
+	}
+
+	jsonStore := CreateStore(100)
+	if err := jsonStore.Recovery(jsonState); err != nil {
+		t.Fatalf("Cannot recover legacy JSON snapshot via Recovery: %s", err)
+	}
+	res, _ = jsonStore.Get("/foo/baz")
+	json.Unmarshal(res, &result)
+	if result.Value != "2" {
+		t.Fatalf("JSON round-trip lost data")
+	}
+}
+
 func TestTestAndSet(t *testing.T) {
 	s := CreateStore(100)
 	s.Set("foo", "bar", time.Unix(0, 0), 1)
@@ -83,6 +299,130 @@ func TestTestAndSet(t *testing.T) {
 
 }
 
+type registryEntry struct {
+	Raft string `json:"raft"`
+	Etcd string `json:"etcd"`
+}
+
+func TestObjectJSONCodec(t *testing.T) {
+	s := CreateStore(100)
+
+	entry := registryEntry{Raft: "127.0.0.1:7001", Etcd: "127.0.0.1:4001"}
+	if _, err := s.SetObject("/registry/1", entry, time.Unix(0, 0), 1); err != nil {
+		t.Fatalf("Cannot SetObject: %s", err)
+	}
+
+	var got registryEntry
+	if err := s.GetObject("/registry/1", &got); err != nil {
+		t.Fatalf("Cannot GetObject: %s", err)
+	}
+	if got != entry {
+		t.Fatalf("GetObject returned %+v, want %+v", got, entry)
+	}
+
+	// the value underneath is still a plain string, readable through Get.
+	res, err := s.Get("/registry/1")
+	if err != nil {
+		t.Fatalf("Cannot Get: %s", err)
+	}
+	var plain Response
+	json.Unmarshal(res, &plain)
+	if plain.Value == "" {
+		t.Fatalf("Expected a marshaled value, got empty string")
+	}
+}
+
+type upperCodec struct{}
+
+func (upperCodec) Marshal(v interface{}) ([]byte, error) {
+	return []byte(strings.ToUpper(v.(string))), nil
+}
+
+func (upperCodec) Unmarshal(data []byte, v interface{}) error {
+	*(v.(*string)) = string(data)
+	return nil
+}
+
+func TestObjectCustomCodec(t *testing.T) {
+	s := CreateStoreWithCodec(100, upperCodec{})
+
+	if _, err := s.SetObject("/foo", "bar", time.Unix(0, 0), 1); err != nil {
+		t.Fatalf("Cannot SetObject: %s", err)
+	}
+
+	var got string
+	if err := s.GetObject("/foo", &got); err != nil {
+		t.Fatalf("Cannot GetObject: %s", err)
+	}
+	if got != "BAR" {
+		t.Fatalf("Expected custom codec to upper-case the value, got %q", got)
+	}
+}
+
+func TestCompareAndSwap(t *testing.T) {
+	s := CreateStore(100)
+	s.Set("foo", "bar", time.Unix(0, 0), 1)
+
+	// value-only predicate
+	if _, err := s.CompareAndSwap("foo", "nope", 0, "baz", time.Unix(0, 0), 2); err != ErrTestFailed {
+		t.Fatalf("Expected ErrTestFailed, got %v", err)
+	}
+	if _, err := s.CompareAndSwap("foo", "bar", 0, "baz", time.Unix(0, 0), 2); err != nil {
+		t.Fatalf("value-only predicate should succeed: %s", err)
+	}
+
+	// index-only predicate; foo's ModifiedIndex is now 2
+	if _, err := s.CompareAndSwap("foo", "", 99, "qux", time.Unix(0, 0), 3); err != ErrIndexMismatch {
+		t.Fatalf("Expected ErrIndexMismatch, got %v", err)
+	}
+	if _, err := s.CompareAndSwap("foo", "", 2, "qux", time.Unix(0, 0), 3); err != nil {
+		t.Fatalf("index-only predicate should succeed: %s", err)
+	}
+
+	// combined predicate; foo is now "qux" with ModifiedIndex 3
+	if _, err := s.CompareAndSwap("foo", "qux", 99, "zzz", time.Unix(0, 0), 4); err != ErrIndexMismatch {
+		t.Fatalf("Expected ErrIndexMismatch for combined predicate, got %v", err)
+	}
+	if _, err := s.CompareAndSwap("foo", "nope", 3, "zzz", time.Unix(0, 0), 4); err != ErrTestFailed {
+		t.Fatalf("Expected ErrTestFailed for combined predicate, got %v", err)
+	}
+	if _, err := s.CompareAndSwap("foo", "qux", 3, "zzz", time.Unix(0, 0), 4); err != nil {
+		t.Fatalf("combined predicate should succeed: %s", err)
+	}
+
+	if _, err := s.CompareAndSwap("missing", "", 0, "zzz", time.Unix(0, 0), 5); err != ErrKeyNotFound {
+		t.Fatalf("Expected ErrKeyNotFound, got %v", err)
+	}
+}
+
+func TestCompareAndSwapByGetModifiedIndex(t *testing.T) {
+	s := CreateStore(100)
+	s.Set("/foo", "bar", time.Unix(0, 0), 1)
+
+	// mutating an unrelated key bumps the store-wide index but must not
+	// affect /foo's own ModifiedIndex.
+	s.Set("/bar", "baz", time.Unix(0, 0), 2)
+	s.Set("/bar", "qux", time.Unix(0, 0), 3)
+
+	res, err := s.Get("/foo")
+	if err != nil {
+		t.Fatalf("Cannot get /foo: %s", err)
+	}
+	var got Response
+	json.Unmarshal(res, &got)
+
+	if got.Index != 3 {
+		t.Fatalf("Expected Response.Index to track the store-wide index 3, got %d", got.Index)
+	}
+	if got.ModifiedIndex != 1 {
+		t.Fatalf("Expected Response.ModifiedIndex to stay at /foo's own last write 1, got %d", got.ModifiedIndex)
+	}
+
+	if _, err := s.CompareAndSwap("/foo", "", got.ModifiedIndex, "swapped", time.Unix(0, 0), 4); err != nil {
+		t.Fatalf("CompareAndSwap against the observed ModifiedIndex should succeed: %s", err)
+	}
+}
+
 func TestSaveAndRecovery(t *testing.T) {
 
 	s := CreateStore(100)
@@ -116,7 +456,7 @@ func TestSaveAndRecovery(t *testing.T) {
 		t.Fatalf("Get expired value")
 	}
 
-	s.Delete("foo", 3)
+	s.Delete("foo", false, 3)
 
 }
 
@@ -183,6 +523,120 @@ func TestExpire(t *testing.T) {
 
 }
 
+func TestSetAlreadyExpiredEmitsOneEvent(t *testing.T) {
+	s := CreateStore(100)
+
+	ch, cancel, err := s.Watch("/foo", 0)
+	if err != nil {
+		t.Fatalf("Cannot watch: %s", err)
+	}
+	defer cancel()
+
+	s.Set("/foo", "bar", time.Now().Add(-time.Second*1), 7)
+
+	var e Response
+	select {
+	case e = <-ch:
+	case <-time.After(time.Second):
+		t.Fatalf("Timed out waiting for the set event")
+	}
+
+	if e.Action != actionSet {
+		t.Fatalf("Expected a single set event, got %s", e.Action)
+	}
+	if e.Index != 7 {
+		t.Fatalf("Expected the caller-supplied index 7, got %d", e.Index)
+	}
+
+	select {
+	case stray := <-ch:
+		t.Fatalf("Got an unexpected second event: %s at index %d", stray.Action, stray.Index)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestWatch(t *testing.T) {
+	s := CreateStore(100)
+
+	ch, cancel, err := s.Watch("/foo", 0)
+	if err != nil {
+		t.Fatalf("Cannot watch: %s", err)
+	}
+
+	s.Set("/foo/bar", "1", time.Unix(0, 0), 1)
+
+	select {
+	case e := <-ch:
+		if e.Key != "/foo/bar" {
+			t.Fatalf("Unexpected event key %s", e.Key)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Timed out waiting for watch event")
+	}
+
+	cancel()
+
+	if _, ok := <-ch; ok {
+		t.Fatalf("Expected channel to be closed after cancel")
+	}
+}
+
+func TestWatchReplay(t *testing.T) {
+	s := CreateStore(100)
+
+	s.Set("/foo", "1", time.Unix(0, 0), 1)
+	s.Set("/foo", "2", time.Unix(0, 0), 2)
+	s.Set("/foo", "3", time.Unix(0, 0), 3)
+
+	ch, cancel, err := s.Watch("/foo", 2)
+	if err != nil {
+		t.Fatalf("Cannot watch: %s", err)
+	}
+	defer cancel()
+
+	e := <-ch
+	if e.Index != 2 {
+		t.Fatalf("Expected replayed event index 2, got %d", e.Index)
+	}
+	e = <-ch
+	if e.Index != 3 {
+		t.Fatalf("Expected replayed event index 3, got %d", e.Index)
+	}
+}
+
+func TestWatchIndexCleared(t *testing.T) {
+	s := CreateStore(2)
+
+	s.Set("/foo", "1", time.Unix(0, 0), 1)
+	s.Set("/foo", "2", time.Unix(0, 0), 2)
+	s.Set("/foo", "3", time.Unix(0, 0), 3)
+
+	if _, _, err := s.Watch("/foo", 1); err != ErrEventIndexCleared {
+		t.Fatalf("Expected ErrEventIndexCleared, got %v", err)
+	}
+}
+
+func TestWatchExpire(t *testing.T) {
+	s := CreateStore(100)
+
+	s.Set("/foo", "1", time.Now().Add(time.Second*1), 1)
+
+	ch, cancel, err := s.Watch("/foo", 0)
+	if err != nil {
+		t.Fatalf("Cannot watch: %s", err)
+	}
+	defer cancel()
+
+	select {
+	case e := <-ch:
+		if e.Action != actionExpire {
+			t.Fatalf("Expected expire event, got %s", e.Action)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("Timed out waiting for expire event")
+	}
+}
+
 func BenchmarkStoreSet(b *testing.B) {
 	s := CreateStore(100)
 
@@ -247,6 +701,24 @@ func BenchmarkSnapshotSaveJson(b *testing.B) {
 
 	var state []byte
 
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		state, _ = s.SaveJSON()
+	}
+	b.SetBytes(int64(len(state)))
+}
+
+func BenchmarkSnapshotSaveSnappy(b *testing.B) {
+	s := CreateStore(100)
+
+	keys := GenKeys(10000, 5)
+
+	for i, key := range keys {
+		s.Set(key, "barbarbarbarbar", time.Unix(0, 0), uint64(i))
+	}
+
+	var state []byte
+
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
 		state, _ = s.Save()
@@ -254,7 +726,26 @@ func BenchmarkSnapshotSaveJson(b *testing.B) {
 	b.SetBytes(int64(len(state)))
 }
 
-func BenchmarkSnapshotRecovery(b *testing.B) {
+func BenchmarkSnapshotRecoveryJson(b *testing.B) {
+	s := CreateStore(100)
+
+	keys := GenKeys(10000, 5)
+
+	for i, key := range keys {
+		s.Set(key, "barbarbarbarbar", time.Unix(0, 0), uint64(i))
+	}
+
+	state, _ := s.SaveJSON()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		newStore := CreateStore(100)
+		newStore.RecoverJSON(state)
+	}
+	b.SetBytes(int64(len(state)))
+}
+
+func BenchmarkSnapshotRecoverySnappy(b *testing.B) {
 	s := CreateStore(100)
 
 	keys := GenKeys(10000, 5)
@@ -272,3 +763,31 @@ func BenchmarkSnapshotRecovery(b *testing.B) {
 	}
 	b.SetBytes(int64(len(state)))
 }
+
+func BenchmarkWatchFanout(b *testing.B) {
+	s := CreateStore(1000)
+
+	const watcherCount = 1000
+	cancels := make([]CancelFunc, watcherCount)
+	for i := 0; i < watcherCount; i++ {
+		ch, cancel, err := s.Watch("/", 0)
+		if err != nil {
+			b.Fatalf("Cannot watch: %s", err)
+		}
+		cancels[i] = cancel
+		go func(ch <-chan Response) {
+			for range ch {
+			}
+		}(ch)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s.Set("/foo", "bar", time.Unix(0, 0), uint64(i+1))
+	}
+	b.StopTimer()
+
+	for _, cancel := range cancels {
+		cancel()
+	}
+}
@@ -0,0 +1,67 @@
+/*
+Copyright 2013 CoreOS Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+// CancelFunc stops a Watch subscription and closes its event channel.
+type CancelFunc func()
+
+// watchChanBuffer is the extra slack given to a watcher's channel beyond
+// whatever history it replays on attach.
+const watchChanBuffer = 16
+
+type watcher struct {
+	ch     chan Response
+	prefix string
+}
+
+// watcherHub fans a mutation event out to every watcher whose prefix
+// contains it.
+type watcherHub struct {
+	watchers []*watcher
+}
+
+func newWatcherHub() *watcherHub {
+	return &watcherHub{}
+}
+
+func (h *watcherHub) add(w *watcher) {
+	h.watchers = append(h.watchers, w)
+}
+
+func (h *watcherHub) remove(w *watcher) {
+	for i, existing := range h.watchers {
+		if existing == w {
+			h.watchers = append(h.watchers[:i], h.watchers[i+1:]...)
+			return
+		}
+	}
+}
+
+// notify delivers e to every matching watcher. A watcher whose channel is
+// full is skipped rather than blocking the caller, which is always holding
+// Store.mu at this point.
+func (h *watcherHub) notify(e Response) {
+	for _, w := range h.watchers {
+		if !underPrefix(e.Key, w.prefix) {
+			continue
+		}
+		select {
+		case w.ch <- e:
+		default:
+		}
+	}
+}